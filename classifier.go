@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Classifier inspects a downloaded image and decides whether it matches a
+// particular pattern (contains text, is a "richtiges grau", ...). A
+// Classifier must be safe to call concurrently from multiple goroutines;
+// only its one-time Configure call (done before the worker pool starts) may
+// mutate its state.
+type Classifier interface {
+	// Name returns the stable, unique identifier of this classifier. It is
+	// used to look up its configuration and to label the tags it produces
+	// in logs.
+	Name() string
+
+	// Classify inspects the image stored at filename and returns the tags
+	// to apply to the item. A nil/empty slice means "no match". ctx carries
+	// the per-classifier timeout configured for this run.
+	Classify(ctx context.Context, filename string) ([]string, error)
+}
+
+// Configurable is implemented by classifiers whose thresholds and emitted
+// tags can be tuned from rules.yaml without recompiling.
+type Configurable interface {
+	Configure(thresholds map[string]float64, tags []string) error
+}
+
+// ClassifierConfig controls whether and how long a single classifier may
+// run for a single item.
+type ClassifierConfig struct {
+	Enabled bool
+	Timeout time.Duration
+}
+
+// DefaultClassifierConfig is used for classifiers that have no explicit
+// entry in the configuration.
+var DefaultClassifierConfig = ClassifierConfig{Enabled: true, Timeout: 30 * time.Second}
+
+var (
+	registry      = map[string]Classifier{}
+	registryOrder []string
+)
+
+// RegisterClassifier adds a classifier to the global registry. Classifiers
+// are expected to register themselves from an init() function. It panics if
+// a classifier with the same name is already registered.
+func RegisterClassifier(c Classifier) {
+	name := c.Name()
+	if _, exists := registry[name]; exists {
+		panic("classifier already registered: " + name)
+	}
+
+	registry[name] = c
+	registryOrder = append(registryOrder, name)
+}
+
+func init() {
+	RegisterClassifier(newTextClassifier())
+	RegisterClassifier(newGrayClassifier())
+}
+
+// textClassifier tags items that contain recognizable text, detected via
+// OCR. MinChars and Tags default to the values baked into the original
+// implementation and can be overridden from rules.yaml.
+type textClassifier struct {
+	MinChars int
+	Tags     []string
+}
+
+func newTextClassifier() *textClassifier {
+	return &textClassifier{MinChars: 30, Tags: []string{"text"}}
+}
+
+func (textClassifier) Name() string { return "text" }
+
+func (c *textClassifier) Configure(thresholds map[string]float64, tags []string) error {
+	if v, ok := thresholds["min_chars"]; ok {
+		c.MinChars = int(v)
+	}
+
+	if len(tags) > 0 {
+		c.Tags = tags
+	}
+
+	return nil
+}
+
+func (c *textClassifier) Classify(ctx context.Context, filename string) ([]string, error) {
+	_, hasText, err := ImageContainsText(ctx, filename, c.MinChars)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasText {
+		return nil, nil
+	}
+
+	return c.Tags, nil
+}
+
+// grayClassifier tags items whose first image row is the "richtiges grau"
+// gradient. Its RGB target, match threshold and match ratio default to the
+// original hardcoded constants and can be overridden from rules.yaml.
+type grayClassifier struct {
+	TargetR, TargetG, TargetB int
+	Threshold                 int
+	MinRatio                  float64
+	Tags                      []string
+}
+
+func newGrayClassifier() *grayClassifier {
+	return &grayClassifier{
+		TargetR:   0x1616,
+		TargetG:   0x1616,
+		TargetB:   0x1818,
+		Threshold: 0x0606,
+		MinRatio:  0.75,
+		Tags:      []string{"richtiges grau"},
+	}
+}
+
+func (grayClassifier) Name() string { return "richtiges grau" }
+
+func (c *grayClassifier) Configure(thresholds map[string]float64, tags []string) error {
+	if v, ok := thresholds["target_r"]; ok {
+		c.TargetR = int(v)
+	}
+
+	if v, ok := thresholds["target_g"]; ok {
+		c.TargetG = int(v)
+	}
+
+	if v, ok := thresholds["target_b"]; ok {
+		c.TargetB = int(v)
+	}
+
+	if v, ok := thresholds["threshold"]; ok {
+		c.Threshold = int(v)
+	}
+
+	if v, ok := thresholds["min_ratio"]; ok {
+		c.MinRatio = v
+	}
+
+	if len(tags) > 0 {
+		c.Tags = tags
+	}
+
+	return nil
+}
+
+func (c *grayClassifier) Classify(ctx context.Context, filename string) ([]string, error) {
+	correctGray, err := ImageContainsCorrectGray(filename, c.TargetR, c.TargetG, c.TargetB, c.Threshold, c.MinRatio)
+	if err != nil {
+		return nil, err
+	}
+
+	if !correctGray {
+		return nil, nil
+	}
+
+	return c.Tags, nil
+}
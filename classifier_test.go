@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGrayClassifierConfigure(t *testing.T) {
+	c := newGrayClassifier()
+
+	if err := c.Configure(map[string]float64{"target_r": 10, "threshold": 5, "min_ratio": 0.5}, []string{"custom"}); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+
+	if c.TargetR != 10 || c.Threshold != 5 || c.MinRatio != 0.5 {
+		t.Fatalf("Configure did not apply thresholds: %+v", c)
+	}
+
+	if len(c.Tags) != 1 || c.Tags[0] != "custom" {
+		t.Fatalf("Configure did not apply tags: %v", c.Tags)
+	}
+}
+
+func TestGrayClassifierConfigureKeepsDefaultsForOmittedFields(t *testing.T) {
+	c := newGrayClassifier()
+
+	if err := c.Configure(map[string]float64{"target_r": 1}, nil); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+
+	if c.TargetG != 0x1616 || c.TargetB != 0x1818 {
+		t.Fatalf("Configure touched fields that had no matching threshold: %+v", c)
+	}
+
+	if len(c.Tags) != 1 || c.Tags[0] != "richtiges grau" {
+		t.Fatalf("Configure overwrote tags despite a nil argument: %v", c.Tags)
+	}
+}
+
+func TestGrayClassifierClassifyMatchesTargetGray(t *testing.T) {
+	filename := writeTestPNG(t, solidFirstRow(20, color.RGBA{R: 0x22, G: 0x22, B: 0x24, A: 0xff}))
+
+	c := &grayClassifier{TargetR: 0x2222, TargetG: 0x2222, TargetB: 0x2424, Threshold: 0x0100, MinRatio: 0.75, Tags: []string{"richtiges grau"}}
+
+	tags, err := c.Classify(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Classify: %s", err)
+	}
+
+	if len(tags) != 1 || tags[0] != "richtiges grau" {
+		t.Fatalf("expected [richtiges grau], got %v", tags)
+	}
+}
+
+func TestGrayClassifierClassifyNoMatch(t *testing.T) {
+	filename := writeTestPNG(t, solidFirstRow(20, color.RGBA{R: 0xff, G: 0x00, B: 0x00, A: 0xff}))
+
+	c := newGrayClassifier()
+
+	tags, err := c.Classify(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Classify: %s", err)
+	}
+
+	if len(tags) != 0 {
+		t.Fatalf("expected no tags, got %v", tags)
+	}
+}
+
+func TestTextClassifierConfigure(t *testing.T) {
+	c := newTextClassifier()
+
+	if err := c.Configure(map[string]float64{"min_chars": 5}, []string{"custom-text"}); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+
+	if c.MinChars != 5 {
+		t.Fatalf("expected MinChars 5, got %d", c.MinChars)
+	}
+
+	if len(c.Tags) != 1 || c.Tags[0] != "custom-text" {
+		t.Fatalf("Configure did not apply tags: %v", c.Tags)
+	}
+}
+
+func TestTextClassifierConfigureKeepsDefaultsForOmittedFields(t *testing.T) {
+	c := newTextClassifier()
+
+	if err := c.Configure(nil, nil); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+
+	if c.MinChars != 30 {
+		t.Fatalf("expected default MinChars 30, got %d", c.MinChars)
+	}
+}
+
+func TestTextClassifierClassifyNoText(t *testing.T) {
+	if _, err := exec.LookPath("tesseract"); err != nil {
+		t.Skip("tesseract not installed")
+	}
+
+	filename := writeTestPNG(t, solidFirstRow(20, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}))
+
+	c := &textClassifier{MinChars: 30, Tags: []string{"text"}}
+
+	tags, err := c.Classify(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("Classify: %s", err)
+	}
+
+	if len(tags) != 0 {
+		t.Fatalf("expected no tags for a blank image, got %v", tags)
+	}
+}
+
+func solidFirstRow(size int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for x := 0; x < size; x++ {
+		img.Set(x, 0, c)
+	}
+	return img
+}
+
+func writeTestPNG(t *testing.T, img image.Image) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.png")
+
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create test image: %s", err)
+	}
+	defer fp.Close()
+
+	if err := png.Encode(fp, img); err != nil {
+		t.Fatalf("encode test image: %s", err)
+	}
+
+	return path
+}
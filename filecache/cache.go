@@ -0,0 +1,269 @@
+// Package filecache implements a content-addressed, size-bounded on-disk
+// cache for downloaded files. Entries are stored under the SHA-256 hash of
+// their cache key (typically a source URL or remote path) together with a
+// JSON sidecar recording size, last-access time and ETag, so integrity can
+// be verified on every read and least-recently-used entries can be evicted
+// once the cache grows past its size limit.
+package filecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Entry describes one cached file. ModTime is bumped on every cache hit, not
+// just on write, so it tracks last access rather than last write and evict
+// can apply a true least-recently-used order.
+type Entry struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag,omitempty"`
+}
+
+// Cache is a directory of content-addressed files, bounded to maxBytes total
+// size via LRU eviction.
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+}
+
+// Open prepares dir (creating it if necessary) as a file cache limited to
+// maxBytes total size. A maxBytes of 0 disables the size limit.
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithMessage(err, "create cache directory")
+	}
+
+	return &Cache{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// Key hashes an arbitrary cache key (e.g. a download URL) into the form used
+// to name files on disk.
+func Key(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Path returns the on-disk location of the cache entry for key, regardless
+// of whether it currently exists. Callers should check Has first.
+func (c *Cache) Path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func (c *Cache) sidecarPath(key string) string {
+	return c.Path(key) + ".json"
+}
+
+// Has reports whether key is present in the cache and its content still
+// matches the hash recorded in its sidecar. A false result (missing,
+// corrupt, or unreadable sidecar) means the caller should re-download and
+// Put. A hit bumps the entry's ModTime so evict treats it as recently used.
+func (c *Cache) Has(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, err := c.readSidecar(key)
+	if err != nil {
+		return Entry{}, false
+	}
+
+	hash, err := hashFile(c.Path(key))
+	if err != nil || hash != entry.Hash {
+		return Entry{}, false
+	}
+
+	entry.ModTime = time.Now()
+	if err := c.writeSidecar(key, entry); err != nil {
+		log.Warnf("touch cache entry %q: %s", key, err)
+	}
+
+	return entry, true
+}
+
+// Put streams body into the cache under key, hashing it as it goes, then
+// atomically (temp file + rename) installs both the content file and its
+// sidecar.
+func (c *Cache) Put(key string, body io.Reader, etag string) (Entry, error) {
+	tmp, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		return Entry{}, errors.WithMessage(err, "create temp file")
+	}
+
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hasher := sha256.New()
+	size, err := io.Copy(tmp, io.TeeReader(body, hasher))
+	closeErr := tmp.Close()
+
+	if err != nil {
+		return Entry{}, errors.WithMessage(err, "write cache entry")
+	}
+
+	if closeErr != nil {
+		return Entry{}, errors.WithMessage(closeErr, "close temp file")
+	}
+
+	entry := Entry{
+		Hash:    hex.EncodeToString(hasher.Sum(nil)),
+		Size:    size,
+		ModTime: time.Now(),
+		ETag:    etag,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmpPath, c.Path(key)); err != nil {
+		return Entry{}, errors.WithMessage(err, "rename cache entry into place")
+	}
+
+	if err := c.writeSidecar(key, entry); err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+func (c *Cache) readSidecar(key string) (Entry, error) {
+	data, err := os.ReadFile(c.sidecarPath(key))
+	if err != nil {
+		return Entry{}, err
+	}
+
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, err
+	}
+
+	return entry, nil
+}
+
+func (c *Cache) writeSidecar(key string, entry Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithMessage(err, "marshal cache entry")
+	}
+
+	tmpPath := c.sidecarPath(key) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.WithMessage(err, "write sidecar")
+	}
+
+	if err := os.Rename(tmpPath, c.sidecarPath(key)); err != nil {
+		return errors.WithMessage(err, "rename sidecar into place")
+	}
+
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer fp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, fp); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// StartEvictor launches a background goroutine that periodically scans the
+// cache directory and removes the least-recently-used entries until the
+// total on-disk size is back under maxBytes. It stops when ctx is done.
+func (c *Cache) StartEvictor(done <-chan struct{}, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := c.evict(); err != nil {
+					log.Warnf("evict cache: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *Cache) evict() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxBytes <= 0 {
+		return nil
+	}
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return errors.WithMessage(err, "list cache directory")
+	}
+
+	type candidate struct {
+		key   string
+		entry Entry
+	}
+
+	var candidates []candidate
+	var total int64
+
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "tmp-") {
+			continue
+		}
+
+		entry, err := c.readSidecar(name)
+		if err != nil {
+			continue
+		}
+
+		candidates = append(candidates, candidate{key: name, entry: entry})
+		total += entry.Size
+	}
+
+	if total <= c.maxBytes {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].entry.ModTime.Before(candidates[j].entry.ModTime)
+	})
+
+	for _, cand := range candidates {
+		if total <= c.maxBytes {
+			break
+		}
+
+		if err := os.Remove(c.Path(cand.key)); err != nil && !os.IsNotExist(err) {
+			return errors.WithMessagef(err, "remove cache entry %q", cand.key)
+		}
+
+		_ = os.Remove(c.sidecarPath(cand.key))
+		total -= cand.entry.Size
+	}
+
+	return nil
+}
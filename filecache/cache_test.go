@@ -0,0 +1,152 @@
+package filecache
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePutThenHas(t *testing.T) {
+	cache, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	key := Key("https://img.pr0gramm.com/some.jpg")
+
+	if _, ok := cache.Has(key); ok {
+		t.Fatalf("expected a fresh cache to not have %q", key)
+	}
+
+	entry, err := cache.Put(key, strings.NewReader("hello world"), "etag-1")
+	if err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if entry.Size != int64(len("hello world")) {
+		t.Fatalf("expected size %d, got %d", len("hello world"), entry.Size)
+	}
+
+	got, ok := cache.Has(key)
+	if !ok {
+		t.Fatalf("expected Has to find the entry just Put")
+	}
+
+	if got.Hash != entry.Hash || got.ETag != "etag-1" {
+		t.Fatalf("Has returned a different entry than Put: %+v != %+v", got, entry)
+	}
+}
+
+func TestCacheHasMissesOnCorruption(t *testing.T) {
+	cache, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	key := Key("https://img.pr0gramm.com/some.jpg")
+
+	if _, err := cache.Put(key, strings.NewReader("hello world"), ""); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if err := os.WriteFile(cache.Path(key), []byte("tampered"), 0644); err != nil {
+		t.Fatalf("tamper with cache entry: %s", err)
+	}
+
+	if _, ok := cache.Has(key); ok {
+		t.Fatalf("expected Has to miss once the on-disk content no longer matches its hash")
+	}
+}
+
+func TestCacheEvictRespectsMaxBytes(t *testing.T) {
+	cache, err := Open(t.TempDir(), 15)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	oldKey := Key("old")
+	if _, err := cache.Put(oldKey, strings.NewReader("0123456789"), ""); err != nil {
+		t.Fatalf("Put old: %s", err)
+	}
+
+	// Put's ModTime comes from time.Now(); make sure the second entry sorts
+	// after the first even on filesystems with coarse mtime resolution.
+	time.Sleep(10 * time.Millisecond)
+
+	newKey := Key("new")
+	if _, err := cache.Put(newKey, strings.NewReader("0123456789"), ""); err != nil {
+		t.Fatalf("Put new: %s", err)
+	}
+
+	if err := cache.evict(); err != nil {
+		t.Fatalf("evict: %s", err)
+	}
+
+	if _, ok := cache.Has(oldKey); ok {
+		t.Fatalf("expected the older entry to have been evicted")
+	}
+
+	if _, ok := cache.Has(newKey); !ok {
+		t.Fatalf("expected the newer entry to survive eviction")
+	}
+}
+
+func TestCacheEvictKeepsRecentlyAccessedEntry(t *testing.T) {
+	cache, err := Open(t.TempDir(), 15)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	oldKey := Key("old")
+	if _, err := cache.Put(oldKey, strings.NewReader("0123456789"), ""); err != nil {
+		t.Fatalf("Put old: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	newKey := Key("new")
+	if _, err := cache.Put(newKey, strings.NewReader("0123456789"), ""); err != nil {
+		t.Fatalf("Put new: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Touching the older entry should make it more recently used than newKey,
+	// so evict must drop newKey instead of oldKey.
+	if _, ok := cache.Has(oldKey); !ok {
+		t.Fatalf("expected Has to find oldKey")
+	}
+
+	if err := cache.evict(); err != nil {
+		t.Fatalf("evict: %s", err)
+	}
+
+	if _, ok := cache.Has(oldKey); !ok {
+		t.Fatalf("expected the recently-accessed entry to survive eviction")
+	}
+
+	if _, ok := cache.Has(newKey); ok {
+		t.Fatalf("expected the untouched, newer-written entry to have been evicted")
+	}
+}
+
+func TestCacheEvictNoopUnderMaxBytes(t *testing.T) {
+	cache, err := Open(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+
+	key := Key("small")
+	if _, err := cache.Put(key, strings.NewReader("hello"), ""); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if err := cache.evict(); err != nil {
+		t.Fatalf("evict: %s", err)
+	}
+
+	if _, ok := cache.Has(key); !ok {
+		t.Fatalf("expected evict to leave entries alone while under maxBytes")
+	}
+}
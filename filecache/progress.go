@@ -0,0 +1,62 @@
+package filecache
+
+import (
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProgressReader wraps an io.Reader and periodically logs the transfer rate
+// and ETA of the copy it is part of, e.g. an io.Copy feeding Cache.Put.
+type ProgressReader struct {
+	io.Reader
+
+	Label string
+	Total int64
+
+	read      int64
+	start     time.Time
+	lastPrint time.Time
+}
+
+// NewProgressReader wraps r, reporting progress for a transfer of the given
+// total size (0 if unknown) under label.
+func NewProgressReader(r io.Reader, label string, total int64) *ProgressReader {
+	now := time.Now()
+	return &ProgressReader{Reader: r, Label: label, Total: total, start: now, lastPrint: now}
+}
+
+func (p *ProgressReader) Read(buf []byte) (int, error) {
+	n, err := p.Reader.Read(buf)
+	p.read += int64(n)
+
+	if now := time.Now(); now.Sub(p.lastPrint) >= time.Second {
+		p.lastPrint = now
+		p.logProgress(now)
+	}
+
+	return n, err
+}
+
+func (p *ProgressReader) logProgress(now time.Time) {
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	rate := float64(p.read) / elapsed
+
+	if p.Total > 0 {
+		remaining := float64(p.Total - p.read)
+
+		eta := "unknown"
+		if rate > 0 {
+			eta = time.Duration(remaining / rate * float64(time.Second)).String()
+		}
+
+		log.Infof("%s: %d/%d bytes (%.1f KB/s, ETA %s)", p.Label, p.read, p.Total, rate/1024, eta)
+	} else {
+		log.Infof("%s: %d bytes (%.1f KB/s)", p.Label, p.read, rate/1024)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mopsalarm/go-pr0gramm"
+	"github.com/mopsalarm/go-pr0gramm-analyze/filecache"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRememberedItems bounds Server.recentItems so it cannot grow without
+// limit; entries are dropped oldest-first once the cap is hit.
+const maxRememberedItems = 10000
+
+// Server is the HTTP control plane for the updater: it lets an operator
+// replay a single item, dry-run classify an arbitrary image URL, and
+// exposes /state and /metrics for monitoring. None of its routes require a
+// credential, and /analyze/* forces real outbound requests and item tags on
+// the caller's behalf, so --listen must never be exposed beyond localhost
+// without a reverse proxy in front of it that adds authentication.
+type Server struct {
+	Session           *pr0gramm.Session
+	State             *State
+	Cache             *filecache.Cache
+	DownloadLimiter   *rateLimiter
+	ClassifierConfigs map[string]ClassifierConfig
+	Workers           int
+
+	// AnalyzeURLTimeout bounds how long handleAnalyzeURL waits on the
+	// attacker-reachable outbound GET before giving up.
+	AnalyzeURLTimeout time.Duration
+
+	// AnalyzeURLMaxBytes caps how many bytes of the response
+	// handleAnalyzeURL will read, so a malicious or unbounded URL can't
+	// fill the cache disk before the evictor next runs.
+	AnalyzeURLMaxBytes int64
+
+	mu          sync.Mutex
+	recentItems map[pr0gramm.Id]pr0gramm.Item
+	itemOrder   []pr0gramm.Id
+	inFlight    int64
+}
+
+// NewServer builds a Server sharing its dependencies with an Updater.
+func NewServer(session *pr0gramm.Session, state *State, cache *filecache.Cache, limiter *rateLimiter, configs map[string]ClassifierConfig, workers int, analyzeURLTimeout time.Duration, analyzeURLMaxBytes int64) *Server {
+	return &Server{
+		Session:            session,
+		State:              state,
+		Cache:              cache,
+		DownloadLimiter:    limiter,
+		ClassifierConfigs:  configs,
+		Workers:            workers,
+		AnalyzeURLTimeout:  analyzeURLTimeout,
+		AnalyzeURLMaxBytes: analyzeURLMaxBytes,
+		recentItems:        map[pr0gramm.Id]pr0gramm.Item{},
+	}
+}
+
+// RememberItem records item so a later POST /analyze/{itemId} can look it
+// up by id; called from Updater.Update as items are fetched from the feed.
+func (s *Server) RememberItem(item pr0gramm.Item) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.recentItems[item.Id]; !exists {
+		s.itemOrder = append(s.itemOrder, item.Id)
+	}
+
+	s.recentItems[item.Id] = item
+
+	for len(s.itemOrder) > maxRememberedItems {
+		delete(s.recentItems, s.itemOrder[0])
+		s.itemOrder = s.itemOrder[1:]
+	}
+}
+
+// SetInFlight reports how many items are currently being processed, shown
+// as "queue_depth" by GET /state.
+func (s *Server) SetInFlight(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight = n
+}
+
+// Handler builds the mux routing /analyze/{itemId}, /analyze/url, /state
+// and /metrics.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analyze/url", s.handleAnalyzeURL)
+	mux.HandleFunc("/analyze/", s.handleAnalyzeItem)
+	mux.HandleFunc("/state", s.handleState)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	return mux
+}
+
+func (s *Server) handleAnalyzeItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/analyze/")
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid item id", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	item, ok := s.recentItems[pr0gramm.Id(id)]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "item not seen recently, cannot look up its image", http.StatusNotFound)
+		return
+	}
+
+	if err := ProcessItem(s.Session, s.Cache, s.DownloadLimiter, s.State, item, s.ClassifierConfigs); err != nil {
+		log.Warnf("Analyzing item %d failed: %s", id, err)
+		http.Error(w, errors.Cause(err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"item_id": id})
+}
+
+func (s *Server) handleAnalyzeURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+		http.Error(w, "expected JSON body with a non-empty \"url\" field", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.AnalyzeURLTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, body.URL, nil)
+	if err != nil {
+		http.Error(w, "invalid \"url\"", http.StatusBadRequest)
+		return
+	}
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, errors.WithMessage(err, "download image").Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer response.Body.Close()
+
+	key := filecache.Key(body.URL)
+
+	limited := io.LimitReader(response.Body, s.AnalyzeURLMaxBytes)
+	progress := filecache.NewProgressReader(limited, body.URL, response.ContentLength)
+	if _, err := s.Cache.Put(key, progress, response.Header.Get("ETag")); err != nil {
+		http.Error(w, errors.WithMessage(err, "cache downloaded image").Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tags, err := runClassifiers(s.Cache.Path(key), s.ClassifierConfigs, nil)
+	if err != nil {
+		http.Error(w, errors.Cause(err).Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"url": body.URL, "tags": tags})
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	inFlight := s.inFlight
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"last_id":     s.State.LastId(),
+		"queue_depth": inFlight,
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if err := metrics.Render(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("Encoding JSON response failed: %s", err)
+	}
+}
+
+// ListenAndServe starts the HTTP control plane on addr. It is meant to be
+// run in its own goroutine; a failure is logged, not fatal, since the
+// updater itself keeps working without it.
+func ListenAndServe(addr string, server *Server) {
+	httpServer := &http.Server{
+		Addr:    addr,
+		Handler: server.Handler(),
+	}
+
+	log.Infof("Listening for control plane requests on %s", addr)
+
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Warnf("HTTP control plane stopped: %s", err)
+	}
+}
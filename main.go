@@ -3,16 +3,21 @@ package main
 import (
 	"context"
 	"github.com/mopsalarm/go-pr0gramm"
+	"github.com/mopsalarm/go-pr0gramm-analyze/filecache"
+	"github.com/mopsalarm/go-pr0gramm-analyze/preproc"
 	"github.com/pkg/errors"
 	"image"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -20,21 +25,71 @@ import (
 	"github.com/jessevdk/go-flags"
 
 	_ "image/jpeg"
-	_ "image/png"
 )
 
-func DownloadItem(item pr0gramm.Item) (string, error) {
-	// create target directory
-	if err := os.MkdirAll("cache", 0755); err != nil {
-		return "", errors.WithMessage(err, "create temporary directory")
+// ocrWindow, ocrK and ocrNoPreproc configure the Sauvola binarization step
+// run before tesseract. They default to the values recommended by Sauvola &
+// Pietikäinen and are overridden from the command line in main().
+var (
+	ocrWindow    = preproc.DefaultWindow
+	ocrK         = preproc.DefaultK
+	ocrNoPreproc = false
+)
+
+// metrics collects the counters exposed via GET /metrics.
+var metrics = NewMetrics()
+
+// rateLimiter throttles callers to at most perSecond Wait() returns per
+// second. A nil *rateLimiter is a valid, unlimited limiter.
+type rateLimiter struct {
+	tokens chan struct{}
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
 	}
 
-	// target file
-	filename := "cache/" + regexp.MustCompile("[^A-Za-z0-9.]+").
-		ReplaceAllString(item.Image, "_")
+	rl := &rateLimiter{tokens: make(chan struct{}, perSecond)}
+
+	go func() {
+		ticker := time.NewTicker(time.Second / time.Duration(perSecond))
+		defer ticker.Stop()
 
-	// source url
-	response, err := http.DefaultClient.Get("https://img.pr0gramm.com/" + item.Image)
+		for range ticker.C {
+			select {
+			case rl.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return rl
+}
+
+func (rl *rateLimiter) Wait() {
+	if rl == nil {
+		return
+	}
+
+	<-rl.tokens
+}
+
+// DownloadItem returns the local path to item's image, downloading it into
+// cache if it is not already present. Downloads against img.pr0gramm.com are
+// throttled via limiter.
+func DownloadItem(cache *filecache.Cache, limiter *rateLimiter, item pr0gramm.Item) (string, error) {
+	key := filecache.Key(item.Image)
+
+	if _, ok := cache.Has(key); ok {
+		return cache.Path(key), nil
+	}
+
+	limiter.Wait()
+
+	url := "https://img.pr0gramm.com/" + item.Image
+
+	response, err := http.DefaultClient.Get(url)
 	if err != nil {
 		return "", errors.WithMessage(err, "download image")
 	}
@@ -45,70 +100,88 @@ func DownloadItem(item pr0gramm.Item) (string, error) {
 		_ = response.Body.Close()
 	}()
 
-	// open target file
-	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY, 0644)
+	progress := filecache.NewProgressReader(response.Body, item.Image, response.ContentLength)
+
+	entry, err := cache.Put(key, progress, response.Header.Get("ETag"))
 	if err != nil {
-		return "", errors.WithMessage(err, "open target file")
+		return "", errors.WithMessage(err, "cache downloaded image")
 	}
 
-	defer fp.Close()
-
-	// copy response to file
-	if _, err = io.Copy(fp, response.Body); err != nil {
-		// delete target file in case of download error
-		_ = os.Remove(filename)
-		return "", errors.WithMessage(err, "downloading")
-	}
+	metrics.AddDownloadBytes(entry.Size)
 
-	return filename, nil
+	return cache.Path(key), nil
 }
 
-func ProcessItem(session *pr0gramm.Session, item pr0gramm.Item) error {
-	logger := log.WithField("item", item.Id)
+// runClassifiers runs every enabled classifier from configs against
+// filename and returns the union of their tags. It is used both by
+// ProcessItem and by the /analyze/url dry-run endpoint.
+func runClassifiers(filename string, configs map[string]ClassifierConfig, state *State) ([]string, error) {
+	var tags []string
 
-	logger.Infof("Downloading")
+	for _, name := range registryOrder {
+		config := DefaultClassifierConfig
+		if c, ok := configs[name]; ok {
+			config = c
+		}
 
-	filename, err := DownloadItem(item)
-	if err != nil {
-		return errors.WithMessage(err, "download image to temp")
-	}
+		if !config.Enabled {
+			continue
+		}
 
-	defer os.Remove(filename)
+		log.Infof("Running classifier %q", name)
 
-	var tags []string
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		found, err := registry[name].Classify(ctx, filename)
+		cancel()
 
-	logger.Infof("Detecting text")
-	_, hasText, err := ImageContainsText(filename)
-	if err != nil {
-		return errors.WithMessage(err, "detecting text")
-	}
+		if state != nil {
+			state.RecordClassifierRun(name, time.Now())
+		}
 
-	if hasText {
-		tags = append(tags, "text")
+		if err != nil {
+			metrics.IncClassifierError(name)
+			return nil, errors.WithMessagef(err, "run classifier %q", name)
+		}
+
+		tags = append(tags, found...)
 	}
 
-	correctGray, err := ImageContainsCorrectGray(filename)
+	return tags, nil
+}
+
+func ProcessItem(session *pr0gramm.Session, cache *filecache.Cache, limiter *rateLimiter, state *State, item pr0gramm.Item, configs map[string]ClassifierConfig) error {
+	logger := log.WithField("item", item.Id)
+
+	metrics.IncItemsScanned()
+
+	logger.Infof("Downloading")
+
+	filename, err := DownloadItem(cache, limiter, item)
 	if err != nil {
-		return errors.WithMessage(err, "detect correct gray")
+		return errors.WithMessage(err, "download image to temp")
 	}
 
-	if correctGray {
-		tags = append(tags, "richtiges grau")
+	tags, err := runClassifiers(filename, configs, state)
+	if err != nil {
+		return err
 	}
 
 	if len(tags) > 0 {
 		logger.Infof("Adding tags: %s", strings.Join(tags, ", "))
 
-		err := session.TagsAdd(item.Id, tags)
-		if err != nil {
+		if err := session.TagsAdd(item.Id, tags); err != nil {
 			return errors.WithMessage(err, "add tag to item")
 		}
+
+		for _, tag := range tags {
+			metrics.AddTag(tag)
+		}
 	}
 
 	return nil
 }
 
-func ImageContainsCorrectGray(filename string) (bool, error) {
+func ImageContainsCorrectGray(filename string, targetR, targetG, targetB, threshold int, minRatio float64) (bool, error) {
 	fp, err := os.Open(filename)
 	if err != nil {
 		return false, errors.WithMessage(err, "open image file")
@@ -127,26 +200,36 @@ func ImageContainsCorrectGray(filename string) (bool, error) {
 	for x := 0; x < width; x++ {
 		r, g, b, _ := image.At(x, 0).RGBA()
 
-		dR := 0x1616 - int(r)
-		dG := 0x1616 - int(g)
-		dB := 0x1818 - int(b)
-
-		th := 0x0606
+		dR := targetR - int(r)
+		dG := targetG - int(g)
+		dB := targetB - int(b)
 
-		if dR*dR+dG*dG+dB*dB < th*th {
+		if dR*dR+dG*dG+dB*dB < threshold*threshold {
 			grayCount++
 		}
 	}
 
-	correctGray := float64(grayCount) > float64(width)*0.75
+	correctGray := float64(grayCount) > float64(width)*minRatio
 	return correctGray, nil
 }
 
-func ImageContainsText(filename string) (string, bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+func ImageContainsText(ctx context.Context, filename string, minChars int) (string, bool, error) {
+	start := time.Now()
+	defer func() { metrics.ObserveOCRDuration(time.Since(start)) }()
+
+	ocrFilename := filename
+
+	if !ocrNoPreproc {
+		binarized, err := binarizeForOCR(filename)
+		if err != nil {
+			return "", false, errors.WithMessage(err, "preprocess image for ocr")
+		}
+
+		defer os.Remove(binarized)
+		ocrFilename = binarized
+	}
 
-	command := exec.CommandContext(ctx, "tesseract", filename, "stdout")
+	command := exec.CommandContext(ctx, "tesseract", ocrFilename, "stdout")
 
 	output, err := command.Output()
 	if err != nil {
@@ -155,14 +238,65 @@ func ImageContainsText(filename string) (string, bool, error) {
 
 	// clean and count chars.
 	cleaned := regexp.MustCompile("[^a-zA-Z.]").ReplaceAllString(string(output), "")
-	return string(output), len(cleaned) > 30, nil
+	return string(output), len(cleaned) > minChars, nil
+}
+
+// binarizeForOCR runs Sauvola local thresholding over filename and writes
+// the result as a PNG into a fresh temp file, returning its path. filename
+// is typically a shared, content-addressed cache entry that multiple
+// concurrent callers may be reading at once, so the output is never derived
+// from filename itself; the caller is responsible for removing the returned
+// file.
+func binarizeForOCR(filename string) (string, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return "", errors.WithMessage(err, "open image file")
+	}
+
+	defer fp.Close()
+
+	img, _, err := image.Decode(fp)
+	if err != nil {
+		return "", errors.WithMessage(err, "decoding image")
+	}
+
+	binarized := preproc.Sauvola(img, ocrWindow, ocrK, preproc.DefaultR)
+
+	out, err := os.CreateTemp(filepath.Dir(filename), "sauvola-*.png")
+	if err != nil {
+		return "", errors.WithMessage(err, "create preprocessed file")
+	}
+
+	defer out.Close()
+
+	if err := png.Encode(out, binarized); err != nil {
+		_ = os.Remove(out.Name())
+		return "", errors.WithMessage(err, "encode preprocessed image")
+	}
+
+	return out.Name(), nil
 }
 
 type Updater struct {
-	Session *pr0gramm.Session
-	Latest  pr0gramm.Id
+	Session           *pr0gramm.Session
+	State             *State
+	ClassifierConfigs map[string]ClassifierConfig
+	Cache             *filecache.Cache
+	DownloadLimiter   *rateLimiter
+	Workers           int
+
+	// Server, if set, is kept informed about items seen and the current
+	// queue depth so the HTTP control plane can serve /analyze/{itemId}
+	// and /state.
+	Server *Server
 }
 
+// Update fetches the current feed and fans ProcessItem out across a pool of
+// u.Workers goroutines, rate-limited against img.pr0gramm.com by
+// u.DownloadLimiter. Items are marked as seen in u.State before being
+// submitted to the pool so a crash doesn't cause them to be retried forever,
+// and Seen guards against re-tagging an item if the visible feed shifts
+// backwards under us.
 func (u *Updater) Update() error {
 	items, err := u.Session.GetItems(pr0gramm.NewItemsRequest())
 	if err != nil {
@@ -175,8 +309,20 @@ func (u *Updater) Update() error {
 		return items.Items[i].Id < items.Items[j].Id
 	})
 
+	workers := u.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
 	for _, item := range items.Items {
-		if item.Id <= u.Latest {
+		if u.Server != nil {
+			u.Server.RememberItem(item)
+		}
+
+		if item.Id <= u.State.LastId() || u.State.Seen(item.Id) {
 			continue
 		}
 
@@ -189,28 +335,88 @@ func (u *Updater) Update() error {
 		}
 
 		// mark as processed so we dont process it twice in case of errors
-		u.Latest = item.Id
+		u.State.MarkSeen(item.Id)
 
-		log.Infof("Checking if item %d https://img.pr0gramm.com/%s has text", item.Id, item.Image)
-		if err := ProcessItem(u.Session, item); err != nil {
-			log.Warnf("Processing failed: %s", err)
-			break
+		item := item
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		if u.Server != nil {
+			u.Server.SetInFlight(int64(len(sem)))
 		}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if u.Server != nil {
+				defer u.Server.SetInFlight(int64(len(sem)))
+			}
+
+			log.Infof("Checking if item %d https://img.pr0gramm.com/%s has text", item.Id, item.Image)
+			if err := ProcessItem(u.Session, u.Cache, u.DownloadLimiter, u.State, item, u.ClassifierConfigs); err != nil {
+				log.Warnf("Processing item %d failed: %s", item.Id, err)
+			}
+		}()
 	}
 
+	wg.Wait()
+
 	return nil
 }
 
 func main() {
 	var args struct {
-		Username string `long:"username" description:"Username to use to access pr0gramm"`
-		Password string `long:"password" description:"Password to use to access pr0gramm"`
+		Username           string        `long:"username" description:"Username to use to access pr0gramm"`
+		Password           string        `long:"password" description:"Password to use to access pr0gramm"`
+		DisableClassifiers []string      `long:"disable-classifier" description:"Name of a classifier to disable, can be given multiple times"`
+		ClassifierTimeout  time.Duration `long:"classifier-timeout" default:"30s" description:"Timeout applied to every classifier run"`
+		OCRWindow          int           `long:"ocr-window" default:"19" description:"Side length of the Sauvola local threshold window"`
+		OCRK               float64       `long:"ocr-k" default:"0.3" description:"Sauvola k parameter"`
+		NoPreproc          bool          `long:"no-preproc" description:"Disable Sauvola binarization and feed the raw image to tesseract"`
+		Workers            int           `long:"workers" default:"4" description:"Number of items to process concurrently"`
+		DownloadRate       int           `long:"download-rate" default:"4" description:"Max downloads per second against img.pr0gramm.com"`
+		CacheMaxBytes      int64         `long:"cache-max-bytes" default:"1073741824" description:"Evict least-recently-used cache/ entries once their total size exceeds this"`
+		RulesPath          string        `long:"rules" default:"rules.yaml" description:"Path to the classifier rules file"`
+		StatePath          string        `long:"state" default:"pr0gramm-analyze.lock" description:"Path to the persisted state lockfile"`
+		Listen             string        `long:"listen" default:":8080" description:"Address for the HTTP control plane (analyze/state/metrics). None of its routes are authenticated, so this must not be exposed beyond localhost without a reverse proxy adding auth in front of it"`
+		AnalyzeURLTimeout  time.Duration `long:"analyze-url-timeout" default:"10s" description:"Timeout for the outbound download made by POST /analyze/url"`
+		AnalyzeURLMaxBytes int64         `long:"analyze-url-max-bytes" default:"33554432" description:"Maximum response size read by POST /analyze/url"`
 	}
 
 	if _, err := flags.Parse(&args); err != nil {
 		os.Exit(1)
 	}
 
+	ocrWindow = args.OCRWindow
+	ocrK = args.OCRK
+	ocrNoPreproc = args.NoPreproc
+
+	rules, err := LoadRules(args.RulesPath)
+	if err != nil {
+		log.WithError(err).Fatal("Could not load rules")
+		return
+	}
+
+	classifierConfigs, err := rules.Apply(args.ClassifierTimeout)
+	if err != nil {
+		log.WithError(err).Fatal("Could not apply rules")
+		return
+	}
+
+	for _, name := range args.DisableClassifiers {
+		config := classifierConfigs[name]
+		config.Enabled = false
+		classifierConfigs[name] = config
+	}
+
+	state, err := LoadState(args.StatePath)
+	if err != nil {
+		log.WithError(err).Fatal("Could not load state")
+		return
+	}
+
 	session := pr0gramm.NewSession(http.Client{Timeout: 10 * time.Second})
 	if resp, err := session.Login(args.Username, args.Password); err != nil {
 		log.WithError(err).Fatal("Could not login")
@@ -222,13 +428,40 @@ func main() {
 		}
 	}
 
-	up := Updater{Session: session}
+	cache, err := filecache.Open("cache", args.CacheMaxBytes)
+	if err != nil {
+		log.WithError(err).Fatal("Could not open cache")
+		return
+	}
+
+	evictorDone := make(chan struct{})
+	defer close(evictorDone)
+	cache.StartEvictor(evictorDone, time.Minute)
+
+	downloadLimiter := newRateLimiter(args.DownloadRate)
+
+	server := NewServer(session, state, cache, downloadLimiter, classifierConfigs, args.Workers, args.AnalyzeURLTimeout, args.AnalyzeURLMaxBytes)
+	go ListenAndServe(args.Listen, server)
+
+	up := Updater{
+		Session:           session,
+		State:             state,
+		ClassifierConfigs: classifierConfigs,
+		Cache:             cache,
+		DownloadLimiter:   downloadLimiter,
+		Workers:           args.Workers,
+		Server:            server,
+	}
 
 	for {
 		if err := up.Update(); err != nil {
 			log.Warnf("Update loop failed: %s", err)
 		}
 
+		if err := state.Save(args.StatePath); err != nil {
+			log.Warnf("Saving state failed: %s", err)
+		}
+
 		log.Infof("Sleeping for a minute")
 		time.Sleep(60 * time.Second)
 	}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ocrDurationBuckets are the upper bounds (in seconds) of the
+// pr0gramm_analyze_ocr_duration_seconds histogram.
+var ocrDurationBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 30}
+
+// Metrics collects the counters exposed via GET /metrics in Prometheus text
+// exposition format. All methods are safe for concurrent use.
+type Metrics struct {
+	itemsScanned  int64
+	downloadBytes int64
+
+	mu               sync.Mutex
+	tagsAdded        map[string]int64
+	classifierErrors map[string]int64
+	ocrBucketCounts  []int64
+	ocrSum           float64
+	ocrCount         int64
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		tagsAdded:        map[string]int64{},
+		classifierErrors: map[string]int64{},
+		ocrBucketCounts:  make([]int64, len(ocrDurationBuckets)),
+	}
+}
+
+func (m *Metrics) IncItemsScanned() {
+	atomic.AddInt64(&m.itemsScanned, 1)
+}
+
+func (m *Metrics) AddDownloadBytes(n int64) {
+	atomic.AddInt64(&m.downloadBytes, n)
+}
+
+func (m *Metrics) AddTag(tag string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tagsAdded[tag]++
+}
+
+func (m *Metrics) IncClassifierError(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.classifierErrors[name]++
+}
+
+func (m *Metrics) ObserveOCRDuration(d time.Duration) {
+	seconds := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ocrSum += seconds
+	m.ocrCount++
+
+	for i, bound := range ocrDurationBuckets {
+		if seconds <= bound {
+			m.ocrBucketCounts[i]++
+		}
+	}
+}
+
+// Render writes all metrics to w in Prometheus text exposition format.
+func (m *Metrics) Render(w io.Writer) error {
+	fmt.Fprintf(w, "# HELP pr0gramm_analyze_items_scanned_total Items inspected since process start.\n")
+	fmt.Fprintf(w, "# TYPE pr0gramm_analyze_items_scanned_total counter\n")
+	fmt.Fprintf(w, "pr0gramm_analyze_items_scanned_total %d\n", atomic.LoadInt64(&m.itemsScanned))
+
+	fmt.Fprintf(w, "# HELP pr0gramm_analyze_download_bytes_total Bytes downloaded from img.pr0gramm.com.\n")
+	fmt.Fprintf(w, "# TYPE pr0gramm_analyze_download_bytes_total counter\n")
+	fmt.Fprintf(w, "pr0gramm_analyze_download_bytes_total %d\n", atomic.LoadInt64(&m.downloadBytes))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP pr0gramm_analyze_tags_added_total Tags added to items, by tag.\n")
+	fmt.Fprintf(w, "# TYPE pr0gramm_analyze_tags_added_total counter\n")
+	for _, tag := range sortedStringInt64Keys(m.tagsAdded) {
+		fmt.Fprintf(w, "pr0gramm_analyze_tags_added_total{tag=%q} %d\n", tag, m.tagsAdded[tag])
+	}
+
+	fmt.Fprintf(w, "# HELP pr0gramm_analyze_classifier_errors_total Classifier run failures, by classifier.\n")
+	fmt.Fprintf(w, "# TYPE pr0gramm_analyze_classifier_errors_total counter\n")
+	for _, name := range sortedStringInt64Keys(m.classifierErrors) {
+		fmt.Fprintf(w, "pr0gramm_analyze_classifier_errors_total{classifier=%q} %d\n", name, m.classifierErrors[name])
+	}
+
+	fmt.Fprintf(w, "# HELP pr0gramm_analyze_ocr_duration_seconds Time spent running OCR, including preprocessing.\n")
+	fmt.Fprintf(w, "# TYPE pr0gramm_analyze_ocr_duration_seconds histogram\n")
+
+	for i, bound := range ocrDurationBuckets {
+		fmt.Fprintf(w, "pr0gramm_analyze_ocr_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.ocrBucketCounts[i])
+	}
+	fmt.Fprintf(w, "pr0gramm_analyze_ocr_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.ocrCount)
+	fmt.Fprintf(w, "pr0gramm_analyze_ocr_duration_seconds_sum %f\n", m.ocrSum)
+	fmt.Fprintf(w, "pr0gramm_analyze_ocr_duration_seconds_count %d\n", m.ocrCount)
+
+	return nil
+}
+
+func sortedStringInt64Keys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+// Package preproc implements image preprocessing steps used to improve OCR
+// recall on noisy or low-contrast screenshots before they are handed to
+// tesseract.
+package preproc
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Default parameters for Sauvola binarization, matching the values
+// recommended by Sauvola & Pietikäinen (2000) for scanned document text.
+const (
+	DefaultWindow = 19
+	DefaultK      = 0.3
+	DefaultR      = 128
+)
+
+// Sauvola binarizes img using Sauvola's local adaptive thresholding
+// algorithm: for every pixel it computes the mean m and standard deviation s
+// of a window x window neighbourhood and thresholds against
+// T = m*(1 + k*(s/r - 1)). Windows are shrunk (not padded or wrapped) at the
+// image border.
+//
+// The local mean and standard deviation are computed in O(1) per pixel via
+// integral images of the grayscale input and of its squared values, so the
+// whole image costs O(width*height) regardless of window size.
+func Sauvola(img image.Image, window int, k float64, r float64) *image.Gray {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	gray := toGray(img)
+	sum, sumSq := integralImages(gray, width, height)
+
+	half := window / 2
+
+	out := image.NewGray(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := maxInt(0, y-half)
+		y1 := minInt(height-1, y+half)
+
+		for x := 0; x < width; x++ {
+			x0 := maxInt(0, x-half)
+			x1 := minInt(width-1, x+half)
+
+			area := float64((x1 - x0 + 1) * (y1 - y0 + 1))
+
+			s := areaSum(sum, width, x0, y0, x1, y1)
+			sq := areaSum(sumSq, width, x0, y0, x1, y1)
+
+			mean := s / area
+
+			variance := sq/area - mean*mean
+			if variance < 0 {
+				variance = 0
+			}
+
+			stdDev := math.Sqrt(variance)
+			threshold := mean * (1 + k*(stdDev/r-1))
+
+			if float64(gray.GrayAt(x, y).Y) < threshold {
+				out.SetGray(x, y, color.Gray{Y: 0})
+			} else {
+				out.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	return out
+}
+
+func toGray(img image.Image) *image.Gray {
+	if g, ok := img.(*image.Gray); ok {
+		return g
+	}
+
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+
+	return gray
+}
+
+// integralImages computes the integral image (summed area table) of gray and
+// of its squared pixel values. Both tables have an implicit zero row/column
+// at index 0, so areaSum never needs to special-case the image border.
+func integralImages(gray *image.Gray, width, height int) (sum, sumSq []float64) {
+	stride := width + 1
+	sum = make([]float64, stride*(height+1))
+	sumSq = make([]float64, stride*(height+1))
+
+	for y := 0; y < height; y++ {
+		var rowSum, rowSumSq float64
+
+		for x := 0; x < width; x++ {
+			v := float64(gray.GrayAt(x, y).Y)
+			rowSum += v
+			rowSumSq += v * v
+
+			idx := (y+1)*stride + (x + 1)
+			above := y*stride + (x + 1)
+			sum[idx] = sum[above] + rowSum
+			sumSq[idx] = sumSq[above] + rowSumSq
+		}
+	}
+
+	return sum, sumSq
+}
+
+// areaSum returns the sum of table over the inclusive pixel rectangle
+// [x0,x1] x [y0,y1], using four lookups into the integral image.
+func areaSum(table []float64, width, x0, y0, x1, y1 int) float64 {
+	stride := width + 1
+	a := table[y0*stride+x0]
+	b := table[y0*stride+(x1+1)]
+	c := table[(y1+1)*stride+x0]
+	d := table[(y1+1)*stride+(x1+1)]
+	return d - b - c + a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,88 @@
+package preproc
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func checkerboard(size int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 0})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func solid(size int, value uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetGray(x, y, color.Gray{Y: value})
+		}
+	}
+	return img
+}
+
+func TestSauvolaSolidImageStaysWhite(t *testing.T) {
+	img := solid(20, 200)
+
+	out := Sauvola(img, DefaultWindow, DefaultK, DefaultR)
+
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			if out.GrayAt(x, y).Y != 255 {
+				t.Fatalf("expected flat image to binarize to all white, got %d at (%d,%d)", out.GrayAt(x, y).Y, x, y)
+			}
+		}
+	}
+}
+
+func TestSauvolaPreservesImageBounds(t *testing.T) {
+	img := checkerboard(17)
+
+	out := Sauvola(img, DefaultWindow, DefaultK, DefaultR)
+
+	if out.Bounds() != img.Bounds() {
+		t.Fatalf("expected output bounds %v to match input bounds %v", out.Bounds(), img.Bounds())
+	}
+}
+
+// TestSauvolaDetectsHighContrastEdge checks that the local thresholding picks
+// up the transition itself: Sauvola drives the threshold below a flat
+// region's own value (see TestSauvolaSolidImageStaysWhite), so only the
+// pixels whose window straddles the edge see enough local contrast to be
+// classified black.
+func TestSauvolaDetectsHighContrastEdge(t *testing.T) {
+	size := 20
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if x < size/2 {
+				img.SetGray(x, y, color.Gray{Y: 0})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	out := Sauvola(img, 5, DefaultK, DefaultR)
+
+	if out.GrayAt(size/2-2, size/2).Y != 0 {
+		t.Fatalf("expected pixel straddling the edge to turn black, got %d", out.GrayAt(size/2-2, size/2).Y)
+	}
+
+	if out.GrayAt(1, size/2).Y != 255 {
+		t.Fatalf("expected flat dark region away from the edge to stay white, got %d", out.GrayAt(1, size/2).Y)
+	}
+
+	if out.GrayAt(size-2, size/2).Y != 255 {
+		t.Fatalf("expected flat light region to stay white, got %d", out.GrayAt(size-2, size/2).Y)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules is the operator-editable configuration loaded from rules.yaml. It
+// controls which registered classifiers run and lets their thresholds and
+// emitted tags be tuned without recompiling.
+type Rules struct {
+	Classifiers map[string]RuleClassifier `yaml:"classifiers"`
+}
+
+// RuleClassifier configures a single classifier, looked up by
+// Classifier.Name(). Enabled is a pointer so "absent" (keep the default) is
+// distinguishable from "false".
+type RuleClassifier struct {
+	Enabled    *bool              `yaml:"enabled,omitempty"`
+	Tags       []string           `yaml:"tags,omitempty"`
+	Thresholds map[string]float64 `yaml:"thresholds,omitempty"`
+}
+
+// LoadRules reads and validates Rules from path. A missing file is not an
+// error; it returns an empty Rules so every registered classifier keeps its
+// built-in defaults.
+func LoadRules(path string) (Rules, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Rules{}, nil
+	}
+
+	if err != nil {
+		return Rules{}, errors.WithMessage(err, "read rules file")
+	}
+
+	var rules Rules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return Rules{}, errors.WithMessagef(err, "parse rules file %q", path)
+	}
+
+	for name := range rules.Classifiers {
+		if _, ok := registry[name]; !ok {
+			return Rules{}, errors.Errorf("rules file %q references unknown classifier %q", path, name)
+		}
+	}
+
+	return rules, nil
+}
+
+// Apply configures every registered Configurable classifier from r and
+// returns the resulting per-classifier enable/timeout configuration for
+// ProcessItem. It must be called once, before the worker pool starts, since
+// Configure is not safe to call concurrently with Classify.
+func (r Rules) Apply(defaultTimeout time.Duration) (map[string]ClassifierConfig, error) {
+	configs := map[string]ClassifierConfig{}
+	for name := range registry {
+		configs[name] = ClassifierConfig{Enabled: true, Timeout: defaultTimeout}
+	}
+
+	for name, rule := range r.Classifiers {
+		config := configs[name]
+		if rule.Enabled != nil {
+			config.Enabled = *rule.Enabled
+		}
+		configs[name] = config
+
+		if len(rule.Thresholds) == 0 && len(rule.Tags) == 0 {
+			continue
+		}
+
+		configurable, ok := registry[name].(Configurable)
+		if !ok {
+			return nil, errors.Errorf("classifier %q does not accept thresholds or tags", name)
+		}
+
+		if err := configurable.Configure(rule.Thresholds, rule.Tags); err != nil {
+			return nil, errors.WithMessagef(err, "configure classifier %q", name)
+		}
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mopsalarm/go-pr0gramm"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// maxRecentIds bounds the set of recently-tagged item ids kept in State, so
+// it cannot grow without limit if the feed shifts under us.
+const maxRecentIds = 1000
+
+// StateData is the on-disk representation of State, persisted to
+// state.yaml (default ./pr0gramm-analyze.lock) so a restart does not
+// re-scan the entire visible feed or re-run classifiers on items the
+// process has already seen.
+type StateData struct {
+	LastId         pr0gramm.Id          `yaml:"last_id"`
+	ClassifierRuns map[string]time.Time `yaml:"classifier_runs,omitempty"`
+	RecentIds      []pr0gramm.Id        `yaml:"recent_ids,omitempty"`
+}
+
+// State wraps StateData with a mutex so it can be updated concurrently by
+// the worker pool in Updater.Update.
+type State struct {
+	mu   sync.Mutex
+	data StateData
+}
+
+// NewState returns an empty State, as used the first time the process runs
+// against a fresh lockfile.
+func NewState() *State {
+	return &State{}
+}
+
+// LoadState reads State from path. A missing file is not an error; it
+// returns an empty State so the process starts from scratch.
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewState(), nil
+	}
+
+	if err != nil {
+		return nil, errors.WithMessage(err, "read state file")
+	}
+
+	var stateData StateData
+	if err := yaml.Unmarshal(data, &stateData); err != nil {
+		return nil, errors.WithMessagef(err, "parse state file %q", path)
+	}
+
+	return &State{data: stateData}, nil
+}
+
+// Save atomically (temp file + rename) writes the state to path.
+func (s *State) Save(path string) error {
+	s.mu.Lock()
+	data, err := yaml.Marshal(s.data)
+	s.mu.Unlock()
+
+	if err != nil {
+		return errors.WithMessage(err, "marshal state")
+	}
+
+	dir := filepath.Dir(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, ".state-*.tmp")
+	if err != nil {
+		return errors.WithMessage(err, "create temp state file")
+	}
+
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.WithMessage(err, "write temp state file")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.WithMessage(err, "close temp state file")
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.WithMessage(err, "rename state file into place")
+	}
+
+	return nil
+}
+
+// LastId returns the highest item id seen so far.
+func (s *State) LastId() pr0gramm.Id {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.LastId
+}
+
+// Seen reports whether id was recently processed, defending against
+// re-tagging items if the visible feed shifts backwards under us.
+func (s *State) Seen(id pr0gramm.Id) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seen := range s.data.RecentIds {
+		if seen == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MarkSeen records id as processed and advances LastId if id is newer.
+func (s *State) MarkSeen(id pr0gramm.Id) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id > s.data.LastId {
+		s.data.LastId = id
+	}
+
+	s.data.RecentIds = append(s.data.RecentIds, id)
+	if len(s.data.RecentIds) > maxRecentIds {
+		s.data.RecentIds = s.data.RecentIds[len(s.data.RecentIds)-maxRecentIds:]
+	}
+}
+
+// RecordClassifierRun notes that name was last run at t.
+func (s *State) RecordClassifierRun(name string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data.ClassifierRuns == nil {
+		s.data.ClassifierRuns = map[string]time.Time{}
+	}
+
+	s.data.ClassifierRuns[name] = t
+}